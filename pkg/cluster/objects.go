@@ -1,15 +1,26 @@
 package cluster
 
 import (
+	"fmt"
+
 	"k8s.io/client-go/pkg/api/resource"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/apis/apps/v1beta1"
+	metav1 "k8s.io/client-go/pkg/apis/meta/v1"
+	policyv1beta1 "k8s.io/client-go/pkg/apis/policy/v1beta1"
+	"k8s.io/client-go/pkg/labels"
 	"k8s.io/client-go/pkg/util/intstr"
 
 	"github.bus.zalan.do/acid/postgres-operator/pkg/util/k8sutil"
 )
 
-func (c *Cluster) createStatefulSet() {
+const pgDataVolumeName = "pgdata"
+
+// generateStatefulSet builds the StatefulSet the operator wants to exist for
+// this cluster, without touching the API server. createStatefulSet and
+// syncStatefulSet both build on top of it: the former to create it, the
+// latter to diff it against what is currently running.
+func (c *Cluster) generateStatefulSet() (*v1beta1.StatefulSet, error) {
 	clusterName := (*c.cluster).Metadata.Name
 
 	envVars := []v1.EnvVar{
@@ -67,23 +78,18 @@ func (c *Cluster) createStatefulSet() {
 		},
 	}
 
-	resourceList := v1.ResourceList{}
+	envVars = c.generatePodEnvVars(envVars)
 
-	if cpu := (*c.cluster).Spec.Resources.Cpu; cpu != "" {
-		resourceList[v1.ResourceCPU] = resource.MustParse(cpu)
-	}
-
-	if memory := (*c.cluster).Spec.Resources.Memory; memory != "" {
-		resourceList[v1.ResourceMemory] = resource.MustParse(memory)
+	resourceRequirements, err := c.generateResourceRequirements()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate resource requirements for cluster '%s': %v", clusterName, err)
 	}
 
 	container := v1.Container{
 		Name:            clusterName,
 		Image:           c.dockerImage,
 		ImagePullPolicy: v1.PullAlways,
-		Resources: v1.ResourceRequirements{
-			Requests: resourceList,
-		},
+		Resources:       resourceRequirements,
 		Ports: []v1.ContainerPort{
 			{
 				ContainerPort: 8008,
@@ -96,8 +102,9 @@ func (c *Cluster) createStatefulSet() {
 		},
 		VolumeMounts: []v1.VolumeMount{
 			{
-				Name:      "pgdata",
-				MountPath: "/home/postgres/pgdata", //TODO: fetch from manifesto
+				Name:      pgDataVolumeName,
+				MountPath: c.volumeMountPath(),
+				SubPath:   c.cluster.Spec.Volume.SubPath,
 			},
 		},
 		Env: envVars,
@@ -107,13 +114,11 @@ func (c *Cluster) createStatefulSet() {
 
 	podSpec := v1.PodSpec{
 		TerminationGracePeriodSeconds: &terminateGracePeriodSeconds,
-		Volumes: []v1.Volume{
-			{
-				Name:         "pgdata",
-				VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}},
-			},
-		},
-		Containers: []v1.Container{container},
+		Containers:                    append([]v1.Container{container}, c.cluster.Spec.Sidecars...),
+		NodeSelector:                  c.generateNodeSelector(),
+		Tolerations:                   c.generateTolerations(),
+		Affinity:                      c.generateAffinity(),
+		PriorityClassName:             c.generatePriorityClassName(),
 	}
 
 	template := v1.PodTemplateSpec{
@@ -124,24 +129,314 @@ func (c *Cluster) createStatefulSet() {
 		Spec: podSpec,
 	}
 
+	volumeClaimTemplate, err := c.volumeClaimTemplate()
+	if err != nil {
+		return nil, fmt.Errorf("could not generate volume claim template for cluster '%s': %v", clusterName, err)
+	}
+
 	statefulSet := &v1beta1.StatefulSet{
 		ObjectMeta: v1.ObjectMeta{
 			Name:   clusterName,
 			Labels: c.labels(),
 		},
 		Spec: v1beta1.StatefulSetSpec{
-			Replicas:    &c.cluster.Spec.NumberOfInstances,
-			ServiceName: clusterName,
-			Template:    template,
+			Replicas:             &c.cluster.Spec.NumberOfInstances,
+			ServiceName:          c.podServiceName(),
+			Template:             template,
+			VolumeClaimTemplates: []v1.PersistentVolumeClaim{volumeClaimTemplate},
 		},
 	}
 
-	c.config.KubeClient.StatefulSets(c.config.Namespace).Create(statefulSet)
+	return statefulSet, nil
+}
+
+func (c *Cluster) createStatefulSet() error {
+	statefulSet, err := c.generateStatefulSet()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.config.KubeClient.StatefulSets(c.config.Namespace).Create(statefulSet)
+	return err
+}
+
+func (c *Cluster) generateNodeSelector() map[string]string {
+	if len(c.cluster.Spec.NodeSelector) > 0 {
+		return c.cluster.Spec.NodeSelector
+	}
+	return c.config.DefaultNodeSelector
 }
 
-func (c *Cluster) applySecrets() {
+func (c *Cluster) generateTolerations() []v1.Toleration {
+	if len(c.cluster.Spec.Tolerations) > 0 {
+		return c.cluster.Spec.Tolerations
+	}
+	return c.config.DefaultTolerations
+}
+
+func (c *Cluster) generatePriorityClassName() string {
+	if c.cluster.Spec.PriorityClassName != "" {
+		return c.cluster.Spec.PriorityClassName
+	}
+	return c.config.DefaultPriorityClassName
+}
+
+// generateAffinity returns the manifest's affinity rules, or - by default -
+// a preferred pod anti-affinity that asks the scheduler to spread a
+// cluster's pods across nodes. Being preferred rather than required, it still
+// lets several pods land on one node when no other node fits.
+func (c *Cluster) generateAffinity() *v1.Affinity {
+	if c.cluster.Spec.Affinity != nil {
+		return c.cluster.Spec.Affinity
+	}
+
+	return &v1.Affinity{
+		PodAntiAffinity: &v1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []v1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: v1.PodAffinityTerm{
+						LabelSelector: &metav1.LabelSelector{MatchLabels: c.labels()},
+						TopologyKey:   "kubernetes.io/hostname",
+					},
+				},
+			},
+		},
+	}
+}
+
+// createPodDisruptionBudget limits voluntary disruptions (e.g. node drains).
+// By default minAvailable is NumberOfInstances-1, so no more than one pod of
+// the cluster is evicted at a time; a MinAvailable set in the manifest's
+// PodDisruptionBudget section replaces that default.
+func (c *Cluster) createPodDisruptionBudget() error {
+	clusterName := (*c.cluster).Metadata.Name
+
+	_, err := c.config.KubeClient.PodDisruptionBudgets(c.config.Namespace).Get(clusterName)
+	if !k8sutil.ResourceNotFound(err) {
+		c.logger.Infof("Pod disruption budget '%s' already exists", clusterName)
+		return nil
+	}
+
+	minAvailableInt := int(c.cluster.Spec.NumberOfInstances) - 1
+	if minAvailableInt < 0 {
+		minAvailableInt = 0
+	}
+	minAvailable := intstr.FromInt(minAvailableInt)
+	if c.cluster.Spec.PodDisruptionBudget.MinAvailable != nil {
+		minAvailable = intstr.FromInt(int(*c.cluster.Spec.PodDisruptionBudget.MinAvailable))
+	}
+
+	pdb := &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: v1.ObjectMeta{
+			Name:   clusterName,
+			Labels: c.labels(),
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable: minAvailable,
+			Selector:     &metav1.LabelSelector{MatchLabels: c.labels()},
+		},
+	}
+
+	if _, err := c.config.KubeClient.PodDisruptionBudgets(c.config.Namespace).Create(pdb); err != nil {
+		return fmt.Errorf("could not create pod disruption budget for cluster '%s': %v", clusterName, err)
+	}
+	return nil
+}
+
+// generateResourceRequirements builds the container CPU/memory requests and
+// limits from the cluster manifest, falling back to the operator's defaults
+// when a quantity is omitted and clamping to the operator's configured
+// min/max bounds. Unlike resource.MustParse, malformed quantities are
+// returned as an error instead of panicking, so the caller can surface the
+// failure through the cluster status rather than crashing the operator.
+func (c *Cluster) generateResourceRequirements() (v1.ResourceRequirements, error) {
+	requestsSpec := c.cluster.Spec.Resources.Requests
+	limitsSpec := c.cluster.Spec.Resources.Limits
+	defaults := c.config.DefaultResources
+
+	requests := v1.ResourceList{}
+	limits := v1.ResourceList{}
+
+	if cpuRequest, ok, err := c.boundedQuantity("CPU request", requestsSpec.Cpu, defaults.Requests.Cpu, defaults.MinCpu, defaults.MaxCpu); err != nil {
+		return v1.ResourceRequirements{}, err
+	} else if ok {
+		requests[v1.ResourceCPU] = cpuRequest
+	}
+
+	if memoryRequest, ok, err := c.boundedQuantity("memory request", requestsSpec.Memory, defaults.Requests.Memory, defaults.MinMemory, defaults.MaxMemory); err != nil {
+		return v1.ResourceRequirements{}, err
+	} else if ok {
+		requests[v1.ResourceMemory] = memoryRequest
+	}
+
+	if cpuLimit, ok, err := c.boundedQuantity("CPU limit", limitsSpec.Cpu, defaults.Limits.Cpu, defaults.MinCpu, defaults.MaxCpu); err != nil {
+		return v1.ResourceRequirements{}, err
+	} else if ok {
+		limits[v1.ResourceCPU] = cpuLimit
+	}
+
+	if memoryLimit, ok, err := c.boundedQuantity("memory limit", limitsSpec.Memory, defaults.Limits.Memory, defaults.MinMemory, defaults.MaxMemory); err != nil {
+		return v1.ResourceRequirements{}, err
+	} else if ok {
+		limits[v1.ResourceMemory] = memoryLimit
+	}
+
+	return v1.ResourceRequirements{
+		Requests: requests,
+		Limits:   limits,
+	}, nil
+}
+
+// boundedQuantity parses value (falling back to defaultValue when empty)
+// and clamps it into [min, max], where either bound may be left empty to
+// mean "unbounded". It returns ok == false, with no error, when both value
+// and defaultValue are empty - meaning the manifest and the operator
+// defaults agree there's no constraint to set, same as the old free-form
+// behavior that added no resource entry at all. name is only used to make
+// parse errors readable.
+func (c *Cluster) boundedQuantity(name, value, defaultValue, min, max string) (resource.Quantity, bool, error) {
+	if value == "" {
+		value = defaultValue
+	}
+	if value == "" {
+		return resource.Quantity{}, false, nil
+	}
+
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return resource.Quantity{}, false, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+
+	if min != "" {
+		if minQuantity, err := resource.ParseQuantity(min); err == nil && quantity.Cmp(minQuantity) < 0 {
+			quantity = minQuantity
+		}
+	}
+
+	if max != "" {
+		if maxQuantity, err := resource.ParseQuantity(max); err == nil && quantity.Cmp(maxQuantity) > 0 {
+			quantity = maxQuantity
+		}
+	}
+
+	return quantity, true, nil
+}
+
+// generatePodEnvVars appends user-supplied env vars from the cluster
+// manifest to the operator-managed ones, so operators can inject sidecar
+// configuration (exporters, log shippers, proxy settings) without rebuilding
+// the Spilo image. Operator-managed names always win: a colliding
+// user-supplied var is dropped and a warning is logged instead of silently
+// overriding cluster bootstrap behavior.
+func (c *Cluster) generatePodEnvVars(operatorEnvVars []v1.EnvVar) []v1.EnvVar {
+	reserved := make(map[string]bool, len(operatorEnvVars))
+	for _, envVar := range operatorEnvVars {
+		reserved[envVar.Name] = true
+	}
+
+	envVars := append([]v1.EnvVar{}, operatorEnvVars...)
+	for _, envVar := range c.cluster.Spec.Env {
+		if reserved[envVar.Name] {
+			c.logger.Warningf("Ignoring user-supplied env var '%s': reserved for operator use", envVar.Name)
+			continue
+		}
+		envVars = append(envVars, envVar)
+	}
+
+	return envVars
+}
+
+// volumeMountPath returns the path at which the pgdata volume is mounted
+// inside the Postgres container, honoring a manifest override.
+func (c *Cluster) volumeMountPath() string {
+	if mountPath := c.cluster.Spec.Volume.MountPath; mountPath != "" {
+		return mountPath
+	}
+	return "/home/postgres/pgdata"
+}
+
+// volumeClaimTemplate builds the PVC template used by the StatefulSet to
+// provision a persistent data volume per pod, sized and classed according
+// to the cluster manifest. A malformed size in the manifest is returned as
+// an error instead of panicking the operator.
+func (c *Cluster) volumeClaimTemplate() (v1.PersistentVolumeClaim, error) {
+	size := c.cluster.Spec.Volume.Size
+	if size == "" {
+		size = c.config.DefaultVolumeSize
+	}
+
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		return v1.PersistentVolumeClaim{}, fmt.Errorf("invalid volume size %q: %v", size, err)
+	}
+
+	annotations := make(map[string]string)
+	if storageClass := c.cluster.Spec.Volume.StorageClass; storageClass != "" {
+		annotations["volume.beta.kubernetes.io/storage-class"] = storageClass
+	}
+
+	return v1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        pgDataVolumeName,
+			Labels:      c.labels(),
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: quantity,
+				},
+			},
+		},
+	}, nil
+}
+
+// deletePersistentVolumeClaims removes the PVCs backing this cluster's pods,
+// honoring the operator-wide retention policy: PVCs are only deleted when
+// EnablePersistentVolumeClaimDeletion is set, otherwise they are left behind
+// for the data to be reclaimed or reused manually. PVCs are found by label
+// selector, not by reconstructing names from the current replica count, so
+// ones left over from a higher replica count before a scale-down are still
+// cleaned up.
+func (c *Cluster) deletePersistentVolumeClaims() {
+	clusterName := (*c.cluster).Metadata.Name
+
+	if !c.config.EnablePersistentVolumeClaimDeletion {
+		c.logger.Infof("Persistent volume claim deletion is disabled, leaving PVCs of cluster '%s' intact", clusterName)
+		return
+	}
+
+	list, err := c.config.KubeClient.PersistentVolumeClaims(c.config.Namespace).List(v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(c.labels()).String(),
+	})
+	if err != nil {
+		c.logger.Errorf("Error while listing PVCs for cluster '%s': %+v", clusterName, err)
+		return
+	}
+
+	for _, pvc := range list.Items {
+		if err := c.config.KubeClient.PersistentVolumeClaims(c.config.Namespace).Delete(pvc.Name, nil); err != nil {
+			c.logger.Errorf("Error while deleting PVC '%s': %+v", pvc.Name, err)
+		} else {
+			c.logger.Infof("PVC '%s' deleted", pvc.Name)
+		}
+	}
+}
+
+func (c *Cluster) applySecrets() error {
 	var err error
+	backend := c.secretBackend()
+
 	for _, user := range c.pgUsers {
+		password := string(user.password)
+		if storedPassword, err := backend.GetPassword(string(user.username)); err == nil && storedPassword != "" {
+			password = storedPassword
+		} else if err := backend.SetPassword(string(user.username), password); err != nil {
+			c.logger.Errorf("Error while storing password for user '%s' in the secret backend: %+v", user.username, err)
+		}
+
 		secret := v1.Secret{
 			ObjectMeta: v1.ObjectMeta{
 				Name:   c.credentialSecretName(string(user.username)),
@@ -150,7 +445,7 @@ func (c *Cluster) applySecrets() {
 			Type: v1.SecretTypeOpaque,
 			Data: map[string][]byte{
 				"username": user.username,
-				"password": user.password,
+				"password": []byte(password),
 			},
 		}
 		_, err = c.config.KubeClient.Secrets(c.config.Namespace).Create(&secret)
@@ -170,35 +465,113 @@ func (c *Cluster) applySecrets() {
 		}
 	}
 
-	//TODO: remove secrets of the deleted users
+	if !c.config.EnableSecretsDeletion {
+		return nil
+	}
+	return c.deleteOrphanedSecrets()
 }
 
-func (c *Cluster) createService() {
-	clusterName := (*c.cluster).Metadata.Name
+const spiloRoleLabel = "spilo-role"
+
+// podServiceName returns the name of the headless Service that governs the
+// StatefulSet, giving every pod a stable DNS record of the form
+// "<pod>.<podServiceName>.<namespace>.svc.cluster.local". It is kept
+// separate from the master/replica Services: those select on Patroni role
+// and are ClusterIP/LoadBalancer, neither of which gets per-pod DNS.
+func (c *Cluster) podServiceName() string {
+	return (*c.cluster).Metadata.Name + "-headless"
+}
 
-	_, err := c.config.KubeClient.Services(c.config.Namespace).Get(clusterName)
+// createHeadlessService creates the headless Service that backs the
+// StatefulSet's per-pod DNS records, used by the rolling update to talk to
+// Patroni on each pod directly.
+func (c *Cluster) createHeadlessService() error {
+	serviceName := c.podServiceName()
+
+	_, err := c.config.KubeClient.Services(c.config.Namespace).Get(serviceName)
 	if !k8sutil.ResourceNotFound(err) {
-		c.logger.Infof("Service '%s' already exists", clusterName)
-		return
+		c.logger.Infof("Service '%s' already exists", serviceName)
+		return nil
 	}
 
 	service := v1.Service{
 		ObjectMeta: v1.ObjectMeta{
-			Name:   clusterName,
+			Name:   serviceName,
 			Labels: c.labels(),
 		},
 		Spec: v1.ServiceSpec{
-			Type:  v1.ServiceTypeClusterIP,
-			Ports: []v1.ServicePort{{Port: 5432, TargetPort: intstr.IntOrString{IntVal: 5432}}},
+			ClusterIP: v1.ClusterIPNone,
+			Selector:  c.labels(),
+			Ports:     []v1.ServicePort{{Port: 5432, TargetPort: intstr.IntOrString{IntVal: 5432}}},
+		},
+	}
+
+	if _, err := c.config.KubeClient.Services(c.config.Namespace).Create(&service); err != nil {
+		c.logger.Errorf("Error while creating headless service '%s': %+v", serviceName, err)
+		return err
+	}
+	c.logger.Infof("Service created: %+v", service)
+	return nil
+}
+
+// createServices creates the headless, master and replica Services for the
+// cluster. The master Service keeps the cluster's bare name for backwards
+// compatibility; the replica Service is suffixed "-repl". Each selects pods
+// by the Patroni role ("master" or "replica") in the spilo-role label.
+func (c *Cluster) createServices() error {
+	if err := c.createHeadlessService(); err != nil {
+		return err
+	}
+	if err := c.createService("master", (*c.cluster).Metadata.Name); err != nil {
+		return err
+	}
+	return c.createService("replica", (*c.cluster).Metadata.Name+"-repl")
+}
+
+func (c *Cluster) createService(role, serviceName string) error {
+	_, err := c.config.KubeClient.Services(c.config.Namespace).Get(serviceName)
+	if !k8sutil.ResourceNotFound(err) {
+		c.logger.Infof("Service '%s' already exists", serviceName)
+		return nil
+	}
+
+	serviceType := v1.ServiceTypeClusterIP
+	if (role == "master" && c.cluster.Spec.EnableMasterLoadBalancer) ||
+		(role == "replica" && c.cluster.Spec.EnableReplicaLoadBalancer) {
+		serviceType = v1.ServiceTypeLoadBalancer
+	}
+
+	selector := map[string]string{}
+	for k, v := range c.labels() {
+		selector[k] = v
+	}
+	selector[spiloRoleLabel] = role
+
+	annotations := c.cluster.Spec.MasterServiceAnnotations
+	if role == "replica" {
+		annotations = c.cluster.Spec.ReplicaServiceAnnotations
+	}
+
+	service := v1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        serviceName,
+			Labels:      c.labels(),
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type:     serviceType,
+			Selector: selector,
+			Ports:    []v1.ServicePort{{Port: 5432, TargetPort: intstr.IntOrString{IntVal: 5432}}},
 		},
 	}
 
 	_, err = c.config.KubeClient.Services(c.config.Namespace).Create(&service)
 	if err != nil {
-		c.logger.Errorf("Error while creating service: %+v", err)
-	} else {
-		c.logger.Infof("Service created: %+v", service)
+		c.logger.Errorf("Error while creating %s service '%s': %+v", role, serviceName, err)
+		return err
 	}
+	c.logger.Infof("Service created: %+v", service)
+	return nil
 }
 
 func (c *Cluster) createEndPoint() {
@@ -0,0 +1,175 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/lib/pq"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/labels"
+)
+
+// SecretBackend stores and retrieves the passwords backing the roles this
+// operator manages. The Kubernetes Secrets store remains the default; an
+// external vault can be configured instead to hold the stored password.
+// applySecrets and rotateSecret still write every password into the
+// Kubernetes Secret the pods read, whichever backend is configured, so a
+// copy of each credential always lives in etcd.
+type SecretBackend interface {
+	GetPassword(username string) (string, error)
+	SetPassword(username, password string) error
+}
+
+// secretBackend picks the SecretBackend configured for the operator.
+func (c *Cluster) secretBackend() SecretBackend {
+	switch c.config.SecretBackend {
+	case "vault":
+		return &vaultSecretBackend{client: c.vaultClient, mountPath: c.config.VaultSecretPath}
+	case "aws-secrets-manager":
+		return &awsSecretsManagerBackend{client: c.awsSecretsManagerClient}
+	default:
+		return &kubernetesSecretBackend{}
+	}
+}
+
+// kubernetesSecretBackend is the operator's original behavior: passwords
+// live only in the Kubernetes Secret the pods already mount, which
+// applySecrets creates and updates directly. It is a no-op here so that
+// bootstrapping a cluster with the default backend doesn't round-trip
+// through the very same Secret applySecrets is about to create.
+type kubernetesSecretBackend struct{}
+
+func (b *kubernetesSecretBackend) GetPassword(username string) (string, error) {
+	return "", nil
+}
+
+func (b *kubernetesSecretBackend) SetPassword(username, password string) error {
+	return nil
+}
+
+type vaultSecretBackend struct {
+	client    *vaultapi.Client
+	mountPath string
+}
+
+func (b *vaultSecretBackend) GetPassword(username string) (string, error) {
+	secret, err := b.client.Logical().Read(path.Join(b.mountPath, username))
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", nil
+	}
+
+	password, _ := secret.Data["password"].(string)
+	return password, nil
+}
+
+func (b *vaultSecretBackend) SetPassword(username, password string) error {
+	_, err := b.client.Logical().Write(path.Join(b.mountPath, username), map[string]interface{}{
+		"password": password,
+	})
+	return err
+}
+
+type awsSecretsManagerBackend struct {
+	client *secretsmanager.SecretsManager
+}
+
+func (b *awsSecretsManagerBackend) GetPassword(username string) (string, error) {
+	out, err := b.client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(username)})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.SecretString), nil
+}
+
+func (b *awsSecretsManagerBackend) SetPassword(username, password string) error {
+	_, err := b.client.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(username),
+		SecretString: aws.String(password),
+	})
+	return err
+}
+
+// rotateSecret generates a fresh password for username, applies it to
+// Postgres itself, then persists it through the configured SecretBackend and
+// mirrors it into the Kubernetes Secret the pods consume. If storing or
+// mirroring fails, the error is returned and the role already has the new
+// password.
+func (c *Cluster) rotateSecret(username string) error {
+	password, err := generatePassword()
+	if err != nil {
+		return fmt.Errorf("could not generate password for user '%s': %v", username, err)
+	}
+
+	// Apply the new password to Postgres first: until this succeeds, nothing
+	// should be told the password changed, or every consumer of the Secret
+	// would start authenticating with a password the database doesn't have.
+	if _, err := c.pgDb.Exec(fmt.Sprintf("ALTER ROLE %s PASSWORD %s", pq.QuoteIdentifier(username), pq.QuoteLiteral(password))); err != nil {
+		return fmt.Errorf("could not alter role '%s': %v", username, err)
+	}
+
+	if err := c.secretBackend().SetPassword(username, password); err != nil {
+		return fmt.Errorf("could not store rotated password for user '%s': %v", username, err)
+	}
+
+	secretName := c.credentialSecretName(username)
+	secret, err := c.config.KubeClient.Secrets(c.config.Namespace).Get(secretName)
+	if err != nil {
+		return fmt.Errorf("could not fetch secret '%s' for rotation: %v", secretName, err)
+	}
+	secret.Data["password"] = []byte(password)
+	if _, err := c.config.KubeClient.Secrets(c.config.Namespace).Update(secret); err != nil {
+		return fmt.Errorf("could not update secret '%s' with rotated password: %v", secretName, err)
+	}
+
+	c.logger.Infof("Password rotated for user '%s'", username)
+	return nil
+}
+
+func generatePassword() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// deleteOrphanedSecrets removes secrets belonging to this cluster whose
+// username no longer appears in c.pgUsers, e.g. after a role was dropped
+// from the manifest.
+func (c *Cluster) deleteOrphanedSecrets() error {
+	clusterName := (*c.cluster).Metadata.Name
+
+	list, err := c.config.KubeClient.Secrets(c.config.Namespace).List(v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(c.labels()).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not list secrets for cluster '%s': %v", clusterName, err)
+	}
+
+	known := make(map[string]bool, len(c.pgUsers))
+	for _, user := range c.pgUsers {
+		known[c.credentialSecretName(string(user.username))] = true
+	}
+
+	for _, secret := range list.Items {
+		if known[secret.Name] {
+			continue
+		}
+		if err := c.config.KubeClient.Secrets(c.config.Namespace).Delete(secret.Name, nil); err != nil {
+			c.logger.Errorf("Error while deleting orphaned secret '%s': %+v", secret.Name, err)
+			continue
+		}
+		c.logger.Infof("Orphaned secret '%s' deleted", secret.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/apps/v1beta1"
+	"k8s.io/client-go/pkg/types"
+
+	"github.bus.zalan.do/acid/postgres-operator/pkg/util/k8sutil"
+)
+
+const (
+	patroniAPIPort       = 8008
+	podReadyPollInterval = 5 * time.Second
+	podReadyTimeout      = 5 * time.Minute
+)
+
+// syncStatefulSet reconciles the live StatefulSet against the one the
+// operator currently wants, creating it if it doesn't exist yet and
+// otherwise patching drift (image, env, resources, replicas, sidecars) and
+// driving the pods through a rolling restart so the new pod template
+// actually gets applied.
+func (c *Cluster) syncStatefulSet() error {
+	clusterName := (*c.cluster).Metadata.Name
+
+	desiredStatefulSet, err := c.generateStatefulSet()
+	if err != nil {
+		return err
+	}
+
+	currentStatefulSet, err := c.config.KubeClient.StatefulSets(c.config.Namespace).Get(clusterName)
+	if k8sutil.ResourceNotFound(err) {
+		_, err = c.config.KubeClient.StatefulSets(c.config.Namespace).Create(desiredStatefulSet)
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("could not fetch current StatefulSet for cluster '%s': %v", clusterName, err)
+	}
+
+	if !statefulSetNeedsUpdate(currentStatefulSet, desiredStatefulSet) {
+		return nil
+	}
+
+	desiredStatefulSet.ObjectMeta.ResourceVersion = currentStatefulSet.ObjectMeta.ResourceVersion
+	if _, err := c.config.KubeClient.StatefulSets(c.config.Namespace).Update(desiredStatefulSet); err != nil {
+		return fmt.Errorf("could not update StatefulSet for cluster '%s': %v", clusterName, err)
+	}
+
+	c.logger.Infof("StatefulSet '%s' patched, rolling out pods", clusterName)
+	return c.rollingUpdate()
+}
+
+// statefulSetNeedsUpdate reports whether current drifts from desired in a
+// way that actually matters. current comes straight from the API server,
+// which fills in a long list of fields the operator never sets (DNSPolicy,
+// RestartPolicy, SchedulerName, per-container TerminationMessagePolicy,
+// RevisionHistoryLimit, UpdateStrategy, ...); diffing the full Spec via
+// reflect.DeepEqual would see drift on every sync and trigger a needless
+// rolling restart. Instead this only looks at what generateStatefulSet
+// actually controls: replica count, scheduling constraints, and per
+// container image/env/resources.
+func statefulSetNeedsUpdate(current, desired *v1beta1.StatefulSet) bool {
+	if current.Spec.Replicas == nil || desired.Spec.Replicas == nil || *current.Spec.Replicas != *desired.Spec.Replicas {
+		return true
+	}
+
+	currentPodSpec := current.Spec.Template.Spec
+	desiredPodSpec := desired.Spec.Template.Spec
+
+	if !reflect.DeepEqual(currentPodSpec.NodeSelector, desiredPodSpec.NodeSelector) {
+		return true
+	}
+	if !reflect.DeepEqual(currentPodSpec.Tolerations, desiredPodSpec.Tolerations) {
+		return true
+	}
+	if !reflect.DeepEqual(currentPodSpec.Affinity, desiredPodSpec.Affinity) {
+		return true
+	}
+	if currentPodSpec.PriorityClassName != desiredPodSpec.PriorityClassName {
+		return true
+	}
+
+	currentContainers := currentPodSpec.Containers
+	desiredContainers := desiredPodSpec.Containers
+	if len(currentContainers) != len(desiredContainers) {
+		return true
+	}
+
+	for i := range desiredContainers {
+		if containerNeedsUpdate(currentContainers[i], desiredContainers[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containerNeedsUpdate(current, desired v1.Container) bool {
+	if current.Image != desired.Image {
+		return true
+	}
+	if !reflect.DeepEqual(current.Env, desired.Env) {
+		return true
+	}
+	if !reflect.DeepEqual(current.Resources.Requests, desired.Resources.Requests) {
+		return true
+	}
+	if !reflect.DeepEqual(current.Resources.Limits, desired.Resources.Limits) {
+		return true
+	}
+	return false
+}
+
+// rollingUpdate restarts the cluster's pods one at a time, replicas first,
+// so that an upgrade can't cause a needless failover: the master is handed
+// off via Patroni's switchover API before its pod is deleted.
+func (c *Cluster) rollingUpdate() error {
+	clusterName := (*c.cluster).Metadata.Name
+
+	members, err := c.patroniClusterMembers(fmt.Sprintf("%s-0", clusterName))
+	if err != nil {
+		return fmt.Errorf("could not determine Patroni cluster state for '%s': %v", clusterName, err)
+	}
+
+	var masterPod string
+	for _, member := range members {
+		if member.Role == "master" {
+			masterPod = member.Name
+			continue
+		}
+		if err := c.restartPod(member.Name); err != nil {
+			return err
+		}
+	}
+
+	if masterPod == "" {
+		return nil
+	}
+
+	if err := c.switchoverOnMaster(masterPod); err != nil {
+		return fmt.Errorf("could not switch over master '%s': %v", masterPod, err)
+	}
+
+	return c.restartPod(masterPod)
+}
+
+func (c *Cluster) restartPod(podName string) error {
+	oldPod, err := c.config.KubeClient.Pods(c.config.Namespace).Get(podName)
+	if err != nil {
+		return fmt.Errorf("could not fetch pod '%s' before deleting it: %v", podName, err)
+	}
+
+	if err := c.config.KubeClient.Pods(c.config.Namespace).Delete(podName, nil); err != nil {
+		return fmt.Errorf("could not delete pod '%s': %v", podName, err)
+	}
+	c.logger.Infof("Pod '%s' deleted for rolling update", podName)
+
+	return c.waitForPodReady(podName, oldPod.UID)
+}
+
+// waitForPodReady polls until a pod named podName is ready, distinct from the
+// one that was just deleted (oldUID), and not itself in the middle of
+// terminating. Without this, a still-terminating old pod can transiently
+// report PodReady=True and let rollingUpdate advance before the replacement
+// is actually up.
+func (c *Cluster) waitForPodReady(podName string, oldUID types.UID) error {
+	deadline := time.Now().Add(podReadyTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(podReadyPollInterval)
+
+		pod, err := c.config.KubeClient.Pods(c.config.Namespace).Get(podName)
+		if err != nil {
+			continue
+		}
+		if pod.UID == oldUID || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if podIsReady(pod) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("pod '%s' did not become ready within %s", podName, podReadyTimeout)
+}
+
+func podIsReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+type patroniClusterMember struct {
+	Name  string `json:"name"`
+	Role  string `json:"role"`
+	State string `json:"state"`
+}
+
+type patroniClusterResponse struct {
+	Members []patroniClusterMember `json:"members"`
+}
+
+// patroniClusterMembers asks Patroni's REST API, reachable through any pod
+// on patroniAPIPort, for the current list of cluster members and their
+// roles. Per-pod DNS only resolves through the StatefulSet's headless
+// governing service, not the master/replica Services, so lookups go
+// through podServiceName.
+func (c *Cluster) patroniClusterMembers(anyPodName string) ([]patroniClusterMember, error) {
+	url := fmt.Sprintf("http://%s.%s.%s.svc.cluster.local:%d/cluster",
+		anyPodName, c.podServiceName(), c.config.Namespace, patroniAPIPort)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var clusterInfo patroniClusterResponse
+	if err := json.NewDecoder(resp.Body).Decode(&clusterInfo); err != nil {
+		return nil, err
+	}
+
+	return clusterInfo.Members, nil
+}
+
+// switchoverOnMaster asks Patroni to hand off primary duties away from
+// masterPodName before its pod is deleted, so a planned restart doesn't
+// surface as an unplanned failover.
+func (c *Cluster) switchoverOnMaster(masterPodName string) error {
+	url := fmt.Sprintf("http://%s.%s.%s.svc.cluster.local:%d/switchover",
+		masterPodName, c.podServiceName(), c.config.Namespace, patroniAPIPort)
+
+	body, err := json.Marshal(map[string]string{"leader": masterPodName})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("patroni switchover request returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}